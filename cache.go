@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// cacheKey identifies one (service, port-type) pair cached by catalogCache,
+// scoped to a datacenter, namespace and partition; each is passed through to
+// the watcher's Consul query.
+type cacheKey struct {
+	SvcName    string
+	SvcType    string
+	Datacenter string
+	Namespace  string
+	Partition  string
+}
+
+type cacheEntry struct {
+	mu       sync.RWMutex
+	options  []RedirectOption
+	lastSeen time.Time
+	cancel   context.CancelFunc
+}
+
+func (e *cacheEntry) touch() {
+	e.mu.Lock()
+	e.lastSeen = time.Now()
+	e.mu.Unlock()
+}
+
+func (e *cacheEntry) idleSince() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return time.Since(e.lastSeen)
+}
+
+// catalogCache maintains a blocking-query watcher per cacheKey (svcName,
+// svcType, datacenter, namespace, partition), so hot lookups are served from memory instead of a Consul
+// round trip. Watchers are started lazily on first request and torn down
+// after -cacheIdleTTL of disuse.
+type catalogCache struct {
+	consul *api.Client
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func newCatalogCache(consul *api.Client) *catalogCache {
+	return &catalogCache{
+		consul:  consul,
+		entries: map[cacheKey]*cacheEntry{},
+	}
+}
+
+// get returns the cached RedirectOptions for key, if a watcher has
+// populated them yet.
+func (c *catalogCache) get(key cacheKey) ([]RedirectOption, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	entry.touch()
+
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+	if entry.options == nil {
+		return nil, false
+	}
+
+	return entry.options, true
+}
+
+// ensureWatcher starts a background blocking-query watcher for key if one
+// isn't already running, subject to -cacheMaxEntries.
+func (c *catalogCache) ensureWatcher(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	if *cacheMaxEntries > 0 && len(c.entries) >= *cacheMaxEntries {
+		log.Printf("catalog cache is at -cacheMaxEntries (%d), not watching %s.%s", *cacheMaxEntries, key.SvcName, key.SvcType)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &cacheEntry{lastSeen: time.Now(), cancel: cancel}
+	c.entries[key] = entry
+
+	go c.watch(ctx, key, entry)
+}
+
+func (c *catalogCache) watch(ctx context.Context, key cacheKey, entry *cacheEntry) {
+	var lastIndex uint64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if entry.idleSince() > *cacheIdleTTL {
+			log.Printf("catalog cache watcher for %s.%s idle for %s, tearing down", key.SvcName, key.SvcType, *cacheIdleTTL)
+			c.evict(key)
+			return
+		}
+
+		services, meta, err := c.consul.Health().Service(key.SvcName, key.SvcType, false, &api.QueryOptions{
+			Datacenter: key.Datacenter,
+			Namespace:  key.Namespace,
+			Partition:  key.Partition,
+			WaitIndex:  lastIndex,
+			WaitTime:   *cacheIdleTTL,
+		})
+		if err != nil {
+			log.Printf("error in catalog cache watcher for %s.%s: %#v", key.SvcName, key.SvcType, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		options := healthEntriesToOptions(services)
+		for i := range options {
+			options[i].Datacenter = key.Datacenter
+		}
+
+		entry.mu.Lock()
+		entry.options = options
+		entry.mu.Unlock()
+	}
+}
+
+func (c *catalogCache) evict(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.cancel()
+		delete(c.entries, key)
+	}
+}
+
+// ServeDebug handles /debug/cache, dumping the current cache contents as JSON.
+func (c *catalogCache) ServeDebug(res http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	type debugEntry struct {
+		SvcName  string           `json:"svc_name"`
+		SvcType  string           `json:"svc_type,omitempty"`
+		Options  []RedirectOption `json:"options"`
+		LastSeen time.Time        `json:"last_seen"`
+	}
+
+	view := make([]debugEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		entry.mu.RLock()
+		view = append(view, debugEntry{
+			SvcName:  key.SvcName,
+			SvcType:  key.SvcType,
+			Options:  entry.options,
+			LastSeen: entry.lastSeen,
+		})
+		entry.mu.RUnlock()
+	}
+	c.mu.Unlock()
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(view); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestParseConsulAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		want     ConsulAddress
+	}{
+		{
+			name:     "service only",
+			hostname: "myservice.service.consul",
+			want:     ConsulAddress{SvcName: "myservice"},
+		},
+		{
+			name:     "port and service",
+			hostname: "myport.myservice.service.consul",
+			want:     ConsulAddress{SvcName: "myport", SvcType: "myservice"},
+		},
+		{
+			name:     "service and bare datacenter",
+			hostname: "myservice.service.dc1.consul",
+			want:     ConsulAddress{SvcName: "myservice", Datacenter: "dc1"},
+		},
+		{
+			name:     "port, service, and bare datacenter",
+			hostname: "myport.myservice.service.dc1.consul",
+			want:     ConsulAddress{SvcName: "myport", SvcType: "myservice", Datacenter: "dc1"},
+		},
+		{
+			name:     "labelled datacenter",
+			hostname: "myservice.service.dc1.dc.consul",
+			want:     ConsulAddress{SvcName: "myservice", Datacenter: "dc1"},
+		},
+		{
+			name:     "labelled namespace only",
+			hostname: "myservice.service.myns.ns.consul",
+			want:     ConsulAddress{SvcName: "myservice", Namespace: "myns"},
+		},
+		{
+			name:     "labelled namespace and partition",
+			hostname: "myservice.service.myns.ns.mypart.ap.consul",
+			want:     ConsulAddress{SvcName: "myservice", Namespace: "myns", Partition: "mypart"},
+		},
+		{
+			name:     "full enterprise form: namespace, partition, and datacenter",
+			hostname: "myservice.service.myns.ns.mypart.ap.dc1.dc.consul",
+			want:     ConsulAddress{SvcName: "myservice", Namespace: "myns", Partition: "mypart", Datacenter: "dc1"},
+		},
+		{
+			name:     "no .service. at all falls back to splitting on the first dot",
+			hostname: "myservice.consul",
+			want:     ConsulAddress{SvcName: "myservice", SvcType: "consul"},
+		},
+		{
+			name:     "looks like an IP address, not parsed",
+			hostname: "1.2.3.4.service.consul",
+			want:     ConsulAddress{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseConsulAddress(tt.hostname)
+			if got != tt.want {
+				t.Errorf("parseConsulAddress(%q) = %+v, want %+v", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCutLabelSuffix(t *testing.T) {
+	tests := []struct {
+		name      string
+		tail      string
+		label     string
+		wantRest  string
+		wantValue string
+		wantOK    bool
+	}{
+		{name: "matches with more left", tail: "a.b.dc", label: "dc", wantRest: "a", wantValue: "b", wantOK: true},
+		{name: "matches with nothing left", tail: "b.dc", label: "dc", wantRest: "", wantValue: "b", wantOK: true},
+		{name: "no match, different label", tail: "a.b.ap", label: "dc", wantRest: "a.b.ap", wantValue: "", wantOK: false},
+		{name: "no match, empty tail", tail: "", label: "dc", wantRest: "", wantValue: "", wantOK: false},
+		{name: "no match, label appears but not as suffix", tail: "dc.a.b", label: "dc", wantRest: "dc.a.b", wantValue: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest, value, ok := cutLabelSuffix(tt.tail, tt.label)
+			if rest != tt.wantRest || value != tt.wantValue || ok != tt.wantOK {
+				t.Errorf("cutLabelSuffix(%q, %q) = (%q, %q, %v), want (%q, %q, %v)",
+					tt.tail, tt.label, rest, value, ok, tt.wantRest, tt.wantValue, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// loadBalancer picks among multiple RedirectOptions for the same hostname
+// in -mode=proxy, per the -lbStrategy flag.
+type loadBalancer struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	inFlight map[string]int64
+}
+
+func newLoadBalancer() *loadBalancer {
+	return &loadBalancer{
+		counters: map[string]uint64{},
+		inFlight: map[string]int64{},
+	}
+}
+
+// pick selects one of options for the given hostname key, according to
+// -lbStrategy. options must be non-empty.
+func (lb *loadBalancer) pick(key string, options []RedirectOption) *RedirectOption {
+	if len(options) == 1 {
+		return &options[0]
+	}
+
+	switch *lbStrategy {
+	case "round-robin":
+		lb.mu.Lock()
+		n := lb.counters[key]
+		lb.counters[key] = n + 1
+		lb.mu.Unlock()
+
+		return &options[n%uint64(len(options))]
+
+	case "least-conn":
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+
+		best := &options[0]
+		bestCount := lb.inFlight[targetKey(best)]
+		for i := 1; i < len(options); i++ {
+			if count := lb.inFlight[targetKey(&options[i])]; count < bestCount {
+				bestCount = count
+				best = &options[i]
+			}
+		}
+
+		return best
+
+	default: // "random"
+		return &options[rand.Intn(len(options))]
+	}
+}
+
+func (lb *loadBalancer) begin(option *RedirectOption) {
+	lb.mu.Lock()
+	lb.inFlight[targetKey(option)]++
+	lb.mu.Unlock()
+}
+
+func (lb *loadBalancer) end(option *RedirectOption) {
+	lb.mu.Lock()
+	lb.inFlight[targetKey(option)]--
+	lb.mu.Unlock()
+}
+
+func targetKey(option *RedirectOption) string {
+	return fmt.Sprintf("%s:%d", option.Hostname, option.Port)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// accessLogEntry is the structured record emitted once per request, in
+// addition to the existing ad-hoc log.Printf lines. Health checks, /metrics
+// and /debug/cache requests are not access-logged.
+type accessLogEntry struct {
+	Host              string  `json:"host"`
+	Path              string  `json:"path"`
+	Outcome           string  `json:"outcome"`
+	BackendHostname   string  `json:"backend_hostname,omitempty"`
+	BackendPort       uint16  `json:"backend_port,omitempty"`
+	ConsulQueryMillis float64 `json:"consul_query_ms,omitempty"`
+}
+
+func logAccess(entry accessLogEntry) {
+	if *logFormat == "json" {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("error marshaling access log entry: %#v", err)
+			return
+		}
+
+		log.Println(string(b))
+		return
+	}
+
+	log.Printf("access host=%s path=%s outcome=%s backend_hostname=%s backend_port=%d consul_query_ms=%.2f",
+		entry.Host, entry.Path, entry.Outcome, entry.BackendHostname, entry.BackendPort, entry.ConsulQueryMillis)
+}
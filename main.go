@@ -2,26 +2,49 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	port              = flag.Uint("port", 80, "http port")
-	nomadUIHostname   = flag.String("nomadUIHostname", "", "the hostname to link to for viewing the Nomad UI")
-	consulUIHostname  = flag.String("consulUIHostname", "", "the hostname to link to for viewing the Consul UI")
-	redirectToNomadUI = flag.Bool("redirectToNomadUI", false, "if true, redirects to the nomad UI when provided a hostname with hostnameSuffix")
-	hostnameSuffix    = flag.String("hostnameSuffix", "", "the hostname suffix for nodes in the cluster")
-	customRoutes      = flag.String("customRoutes", "{}", "a JSON key-value map of custom routings based on hostname")
+	port                 = flag.Uint("port", 80, "http port")
+	nomadUIHostname      = flag.String("nomadUIHostname", "", "the hostname to link to for viewing the Nomad UI")
+	consulUIHostname     = flag.String("consulUIHostname", "", "the hostname to link to for viewing the Consul UI")
+	redirectToNomadUI    = flag.Bool("redirectToNomadUI", false, "if true, redirects to the nomad UI when provided a hostname with hostnameSuffix")
+	hostnameSuffix       = flag.String("hostnameSuffix", "", "the hostname suffix for nodes in the cluster")
+	customRoutes         = flag.String("customRoutes", "{}", "a JSON key-value map of custom routings based on hostname")
+	onlyHealthy          = flag.Bool("onlyHealthy", false, "if true, only redirect to Consul service instances in the 'passing' health state")
+	healthFilter         = flag.String("healthFilter", "any", "minimum Consul health status an instance must have to be considered: passing, warning, or any. Setting -onlyHealthy implies passing")
+	tagPrefix            = flag.String("tagPrefix", "redir-", "the service tag prefix that defines a tag-driven routing rule, e.g. redir-foo.example.com/path")
+	routeRefreshInterval = flag.Duration("routeRefreshInterval", 30*time.Second, "how often to rebuild the tag-driven route table from the Consul catalog")
+	tlsPort              = flag.Uint("tlsPort", 443, "https port, used when -selfSigned or both -certDir and -keyDir are set")
+	certDir              = flag.String("certDir", "", "directory of PEM certificate files to serve over TLS, named to match their -keyDir counterpart")
+	keyDir               = flag.String("keyDir", "", "directory of PEM private key files matching -certDir")
+	selfSigned           = flag.Bool("selfSigned", false, "if true, generate an in-memory CA at startup and mint per-SNI leaf certificates on demand instead of loading -certDir/-keyDir")
+	mode                 = flag.String("mode", "redirect", "how to forward a resolved Consul target: redirect (HTTP 307) or proxy (reverse proxy)")
+	lbStrategy           = flag.String("lbStrategy", "random", "load balancing strategy used to pick among multiple Consul targets in -mode=proxy: random, round-robin, or least-conn")
+	proxyDialTimeout     = flag.Duration("proxyDialTimeout", 10*time.Second, "dial timeout for -mode=proxy backend connections")
+	proxyIdleConnTimeout = flag.Duration("proxyIdleConnTimeout", 90*time.Second, "idle connection timeout for the -mode=proxy transport")
+	proxyMaxIdleConns    = flag.Int("proxyMaxIdleConnsPerHost", 10, "max idle keep-alive connections per backend host in -mode=proxy")
+	logFormat            = flag.String("logFormat", "text", "access log format: text or json")
+	cacheEnabled         = flag.Bool("cacheEnabled", false, "if true, serve catalog lookups from an in-memory cache kept fresh by Consul blocking queries")
+	cacheMaxEntries      = flag.Int("cacheMaxEntries", 1000, "max number of (service, port type) pairs the catalog cache will watch at once; 0 means unlimited")
+	cacheIdleTTL         = flag.Duration("cacheIdleTTL", 5*time.Minute, "how long a catalog cache watcher may go unused before it is torn down")
+	datacenters          = flag.String("datacenters", "", "comma-separated Consul datacenters to fan out across when a hostname doesn't specify one; empty means the agent's default datacenter")
 )
 
 var (
@@ -33,8 +56,8 @@ var (
 <ul>
 {{ range .Results }}
 <li>
-	<a href="{{.Url}}">
-		{{.FullHostname}} port {{.Port}}{{.Tags}}
+	{{ if .HealthStatus }}<span title="{{.HealthDetail}}" style="color: {{.HealthColor}};">&#9679;</span> {{ end }}<a href="{{.Url}}">
+		{{.FullHostname}} port {{.Port}}{{.Tags}}{{ if .Datacenter }} (dc: {{.Datacenter}}){{ end }}
 	</a>
 </li>
 {{ end }}
@@ -54,6 +77,7 @@ var (
 <li><b>PortName</b>.<b>ServiceName</b>.service.consul</li>
 <li><b>ServiceName</b>.service.<b>DatacenterName</b>.consul</li>
 <li><b>PortName</b>.<b>ServiceName</b>.service.<b>DatacenterName</b>.consul</li>
+<li><b>ServiceName</b>.service.<b>Namespace</b>.ns.<b>Partition</b>.ap.<b>DatacenterName</b>.dc.consul (Consul Enterprise)</li>
 </ul>
 `))
 )
@@ -74,15 +98,44 @@ func runServer() error {
 	}
 
 	http.Handle("/", s)
-	log.Printf("listening on port :%d", *port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+
+	errCh := make(chan error, 2)
+
+	go func() {
+		log.Printf("listening on port :%d", *port)
+		errCh <- http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+	}()
+
+	if *selfSigned || (*certDir != "" && *keyDir != "") {
+		tlsMgr, err := newTLSManager()
+		if err != nil {
+			return err
+		}
+
+		tlsServer := &http.Server{
+			Addr:      fmt.Sprintf(":%d", *tlsPort),
+			Handler:   s,
+			TLSConfig: &tls.Config{GetCertificate: tlsMgr.GetCertificate},
+		}
+
+		go func() {
+			log.Printf("listening on TLS port :%d", *tlsPort)
+			errCh <- tlsServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	return <-errCh
 }
 
 // Server implements a http.Handler to serve HTTP requests
 // with a redirect to the correct port of the Consul service
 type Server struct {
-	consul       *api.Client
-	customRoutes map[string]string
+	consul         *api.Client
+	customRoutes   map[string]string
+	routes         *routeTable
+	lb             *loadBalancer
+	proxyTransport *http.Transport
+	cache          *catalogCache
 }
 
 func NewServer() (*Server, error) {
@@ -96,10 +149,93 @@ func NewServer() (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{
+	s := &Server{
 		consul:       client,
 		customRoutes: parsedCustomRoutes,
-	}, nil
+		routes:       newRouteTable(),
+		lb:           newLoadBalancer(),
+		cache:        newCatalogCache(client),
+	}
+
+	if *mode == "proxy" {
+		s.proxyTransport = &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: *proxyDialTimeout,
+			}).DialContext,
+			IdleConnTimeout:     *proxyIdleConnTimeout,
+			MaxIdleConnsPerHost: *proxyMaxIdleConns,
+		}
+	}
+
+	go s.watchRoutes(context.Background())
+
+	return s, nil
+}
+
+// forward sends the request on to option, either via an HTTP redirect or,
+// in -mode=proxy, by reverse-proxying the request through to it directly.
+// It reports whether it actually forwarded the request, so callers can
+// record outcome/metrics based on what happened rather than what they
+// hoped would happen.
+func (s *Server) forward(res http.ResponseWriter, req *http.Request, hostname string, option *RedirectOption) bool {
+	fullHostname := addHostnameSuffix(option.Hostname)
+	u, err := option.BuildURL(fullHostname, req.URL)
+	if err != nil {
+		log.Printf("error building URL for %s: %#v", hostname, err)
+
+		res.Header().Set("Content-Type", "text/html")
+		res.WriteHeader(http.StatusInternalServerError)
+		data := struct {
+			Hostname string
+			Error    error
+		}{
+			Hostname: hostname,
+			Error:    err,
+		}
+		if err := tUrlBuildingError.Execute(res, data); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+
+		return false
+	}
+
+	if *mode == "proxy" {
+		s.proxyTo(res, req, u, option)
+		return true
+	}
+
+	log.Printf("redirecting to %s", u.String())
+	http.Redirect(res, req, u.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// proxyTo reverse-proxies req through to target, tracking the in-flight
+// request against option for the least-conn load balancing strategy.
+// httputil.ReverseProxy already handles websocket upgrades transparently.
+func (s *Server) proxyTo(res http.ResponseWriter, req *http.Request, target *url.URL, option *RedirectOption) {
+	s.lb.begin(option)
+	defer s.lb.end(option)
+
+	proxy := &httputil.ReverseProxy{
+		Transport: s.proxyTransport,
+		Director: func(r *http.Request) {
+			forwardedHost := r.Host
+			forwardedProto := "http"
+			if r.TLS != nil {
+				forwardedProto = "https"
+			}
+
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.Host = target.Host
+
+			r.Header.Set("X-Forwarded-Host", forwardedHost)
+			r.Header.Set("X-Forwarded-Proto", forwardedProto)
+		},
+	}
+
+	log.Printf("proxying %s%s to %s", req.Host, req.URL.Path, target.String())
+	proxy.ServeHTTP(res, req)
 }
 
 func parseCustomRoutes(raw string) (map[string]string, error) {
@@ -124,21 +260,63 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// No prometheus metrics (yet)
 	if strings.HasPrefix(strings.TrimPrefix(req.URL.Path, "/"), "metrics") {
-		res.WriteHeader(200)
+		promhttp.Handler().ServeHTTP(res, req)
+		return
+	}
+
+	if *cacheEnabled && strings.HasPrefix(req.URL.Path, "/debug/cache") {
+		s.cache.ServeDebug(res, req)
 		return
 	}
 
 	hostname := getHostname(req)
 	log.Printf("request: %s%s", req.Host, req.URL.Path)
 
+	outcome := "unknown"
+	var backendHostname string
+	var backendPort uint16
+	var consulQueryMillis float64
+
+	defer func() {
+		metricRequestsTotal.WithLabelValues(outcome).Inc()
+		logAccess(accessLogEntry{
+			Host:              req.Host,
+			Path:              req.URL.Path,
+			Outcome:           outcome,
+			BackendHostname:   backendHostname,
+			BackendPort:       backendPort,
+			ConsulQueryMillis: consulQueryMillis,
+		})
+	}()
+
+	if route, ok := s.routes.match(hostname, req.URL.Path); ok {
+		targetHost := addHostnameSuffix(route.TargetHost)
+		redirUrl, err := buildUrlWithPort(targetHost, req.URL, route.Scheme, route.Port)
+		if err == nil {
+			if route.Strip != "" {
+				redirUrl.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(redirUrl.Path, route.Strip), "/")
+			}
+
+			log.Printf("redirecting %s%s to %s via tag route", req.Host, req.URL.Path, redirUrl.String())
+			outcome = "redirect"
+			backendHostname = route.TargetHost
+			backendPort = route.Port
+			http.Redirect(res, req, redirUrl.String(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		log.Printf("error building URL for tag route to %s: %#v", hostname, err)
+	}
+
 	if redirUrl, ok := s.customRoutes[hostname]; ok {
+		outcome = "custom_route"
 		http.Redirect(res, req, redirUrl, http.StatusTemporaryRedirect)
 		return
 	} else if strings.HasSuffix(hostname, fmt.Sprintf(".%s", *hostnameSuffix)) {
 		cutHostname := strings.TrimSuffix(hostname, fmt.Sprintf(".%s", *hostnameSuffix))
 		if redirUrl, ok := s.customRoutes[cutHostname]; ok {
+			outcome = "custom_route"
 			http.Redirect(res, req, redirUrl, http.StatusTemporaryRedirect)
 			return
 		}
@@ -155,6 +333,7 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			log.Printf("error building URL with %s: %#v", hostname, err)
 
+			outcome = "parse_error"
 			res.Header().Set("Content-Type", "text/html")
 			res.WriteHeader(http.StatusInternalServerError)
 			data := struct {
@@ -171,14 +350,17 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		outcome = "nomad_ui"
 		http.Redirect(res, req, redirUrl.String(), http.StatusTemporaryRedirect)
 		return
 	}
 
-	svcName, svcType := parseConsulAddress(hostname)
+	svcAddr := parseConsulAddress(hostname)
+	svcName, svcType := svcAddr.SvcName, svcAddr.SvcType
 	if svcName == "" {
 		log.Printf("unable to parse hostname as a Consul service address: %s", hostname)
 
+		outcome = "parse_error"
 		res.Header().Set("Content-Type", "text/html")
 		err := tHostnameParseError.Execute(res, hostname)
 		if err != nil {
@@ -190,10 +372,16 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	queryStart := time.Now()
 	result, err := s.queryConsulForHostname(context.Background(), hostname)
+	consulQueryMillis = float64(time.Since(queryStart).Microseconds()) / 1000
+
 	if err != nil {
 		log.Printf("error querying Consul for %s: %#v", hostname, err)
 
+		outcome = "consul_error"
+		metricConsulQueryDuration.WithLabelValues(outcome).Observe(time.Since(queryStart).Seconds())
+
 		res.Header().Set("Content-Type", "text/html")
 		res.WriteHeader(http.StatusInternalServerError)
 		data := struct {
@@ -211,30 +399,30 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if len(result) == 1 {
-		u, err := result[0].BuildURL(hostname, req.URL)
-		if err != nil {
-			log.Printf("error building URL for %s: %#v", hostname, err)
-			res.Header().Set("Content-Type", "text/html")
-			res.WriteHeader(http.StatusInternalServerError)
-			data := struct {
-				Hostname string
-				Error    error
-			}{
-				Hostname: hostname,
-				Error:    err,
-			}
-			err = tUrlBuildingError.Execute(res, data)
-			if err != nil {
-				http.Error(res, err.Error(), http.StatusInternalServerError)
-			}
+	metricConsulQueryDuration.WithLabelValues("ok").Observe(time.Since(queryStart).Seconds())
 
-			return
+	if len(result) == 1 {
+		backendHostname = result[0].Hostname
+		backendPort = result[0].Port
+		if s.forward(res, req, hostname, &result[0]) {
+			outcome = "redirect"
+			metricRedirectsByService.WithLabelValues(svcName, svcType, result[0].Datacenter).Inc()
+		} else {
+			outcome = "parse_error"
 		}
+		return
+	}
 
-		log.Printf("redirecting to %s", u.String())
-
-		http.Redirect(res, req, u.String(), http.StatusTemporaryRedirect)
+	if *mode == "proxy" && len(result) > 1 {
+		option := s.lb.pick(hostname, result)
+		backendHostname = option.Hostname
+		backendPort = option.Port
+		if s.forward(res, req, hostname, option) {
+			outcome = "redirect"
+			metricRedirectsByService.WithLabelValues(svcName, svcType, option.Datacenter).Inc()
+		} else {
+			outcome = "parse_error"
+		}
 		return
 	}
 
@@ -244,6 +432,7 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 
 	if len(result) == 0 {
+		outcome = "not_found"
 		res.Header().Set("Content-Type", "text/html")
 
 		res.WriteHeader(http.StatusNotFound)
@@ -264,6 +453,7 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	outcome = "redirect"
 	res.Header().Set("Content-Type", "text/html")
 
 	data := struct {
@@ -274,6 +464,10 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			FullHostname string
 			Port         uint16
 			Tags         string
+			HealthStatus string
+			HealthColor  string
+			HealthDetail string
+			Datacenter   string
 		}
 	}{
 		SvcName:        svcName,
@@ -298,11 +492,19 @@ func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			FullHostname string
 			Port         uint16
 			Tags         string
+			HealthStatus string
+			HealthColor  string
+			HealthDetail string
+			Datacenter   string
 		}{
 			Url:          u,
 			FullHostname: fullHostname,
 			Port:         option.Port,
 			Tags:         tags,
+			HealthStatus: option.HealthStatus,
+			HealthColor:  option.HealthColor(),
+			HealthDetail: option.HealthDetail,
+			Datacenter:   option.Datacenter,
 		})
 	}
 
@@ -357,9 +559,72 @@ func addHostnameSuffix(hostname string) string {
 
 // RedirectOption corresponds to a Consul service+port pair which can be redirected to
 type RedirectOption struct {
-	Hostname string
-	Tags     []string
-	Port     uint16
+	Hostname     string
+	Tags         []string
+	Port         uint16
+	HealthStatus string
+	HealthDetail string
+	Datacenter   string
+}
+
+// HealthColor returns the CSS color to render HealthStatus as in the multi-result list
+func (r *RedirectOption) HealthColor() string {
+	switch r.HealthStatus {
+	case api.HealthPassing:
+		return "green"
+	case api.HealthWarning:
+		return "darkorange"
+	case api.HealthCritical:
+		return "red"
+	default:
+		return "gray"
+	}
+}
+
+// healthStatusRank orders Consul health statuses from best to worst, so the
+// worst status among a node's checks can be picked as its aggregate status.
+func healthStatusRank(status string) int {
+	switch status {
+	case api.HealthPassing:
+		return 0
+	case api.HealthWarning:
+		return 1
+	case api.HealthCritical:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// aggregateHealth reduces a set of Consul health checks down to the single
+// worst status, along with the output of the check responsible for it.
+func aggregateHealth(checks api.HealthChecks) (status, detail string) {
+	status = api.HealthPassing
+	for _, check := range checks {
+		if healthStatusRank(check.Status) > healthStatusRank(status) {
+			status = check.Status
+			detail = check.Output
+		}
+	}
+	return status, detail
+}
+
+// minHealthRank returns the minimum acceptable health rank given the
+// -onlyHealthy and -healthFilter flags, and whether health data should be
+// queried at all.
+func minHealthRank() (rank int, filtering bool) {
+	if *onlyHealthy {
+		return healthStatusRank(api.HealthPassing), true
+	}
+
+	switch *healthFilter {
+	case api.HealthPassing:
+		return healthStatusRank(api.HealthPassing), true
+	case api.HealthWarning:
+		return healthStatusRank(api.HealthWarning), true
+	default:
+		return healthStatusRank(api.HealthCritical), false
+	}
 }
 
 // BuildURL replaces the port in the given URL provided an original URL and hostname override
@@ -392,41 +657,148 @@ func (r *RedirectOption) guessScheme() string {
 }
 
 func (s *Server) queryConsulForHostname(ctx context.Context, hostname string) ([]RedirectOption, error) {
-	var options []RedirectOption
+	addr := parseConsulAddress(hostname)
+	if addr.SvcName == "" && addr.SvcType == "" {
+		return nil, nil
+	}
+
+	datacenters := []string{addr.Datacenter}
+	if addr.Datacenter == "" {
+		if dcs := datacentersFlagValue(); len(dcs) > 0 {
+			datacenters = dcs
+		}
+	}
+
+	var all []RedirectOption
+	var lastErr error
+
+	for _, dc := range datacenters {
+		options, err := s.queryConsulDatacenter(hostname, addr, dc)
+		if err != nil {
+			lastErr = err
+			log.Printf("error querying Consul for %s in datacenter %q: %#v", hostname, dc, err)
+			continue
+		}
+
+		all = append(all, options...)
+	}
+
+	if len(all) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Hostname < all[j].Hostname && all[i].Port < all[j].Port
+	})
+
+	return all, nil
+}
+
+// queryConsulDatacenter resolves addr within a single datacenter (dc == ""
+// meaning the local agent's default), consulting the catalog cache first
+// when -cacheEnabled.
+func (s *Server) queryConsulDatacenter(hostname string, addr ConsulAddress, dc string) ([]RedirectOption, error) {
+	key := cacheKey{SvcName: addr.SvcName, SvcType: addr.SvcType, Datacenter: dc, Namespace: addr.Namespace, Partition: addr.Partition}
+
+	if *cacheEnabled {
+		if options, ok := s.cache.get(key); ok {
+			metricCacheHits.Inc()
+			return options, nil
+		}
 
-	svcName, svcType := parseConsulAddress(hostname)
-	if svcName == "" && svcType == "" {
-		return options, nil
+		metricCacheMisses.Inc()
+		s.cache.ensureWatcher(key)
 	}
 
-	services, _, err := s.consul.Catalog().Service(svcName, svcType, &api.QueryOptions{})
+	services, _, err := s.consul.Health().Service(addr.SvcName, addr.SvcType, false, &api.QueryOptions{
+		Datacenter: dc,
+		Namespace:  addr.Namespace,
+		Partition:  addr.Partition,
+	})
 	if err != nil {
-		return options, err
+		return nil, err
 	}
 
-	log.Printf("found %d options for hostname %s:", len(services), hostname)
+	log.Printf("found %d options for hostname %s in datacenter %q:", len(services), hostname, dc)
 	for _, svc := range services {
-		log.Printf("%s port %d: %#v", svc.Address, svc.ServicePort, *svc)
+		log.Printf("%s port %d: %#v", svc.Service.Address, svc.Service.Port, *svc.Service)
+	}
+
+	options := healthEntriesToOptions(services)
+	for i := range options {
+		options[i].Datacenter = dc
+	}
+
+	return options, nil
+}
+
+// datacentersFlagValue splits -datacenters into a clean list of datacenter
+// names, dropping empty entries from stray commas.
+func datacentersFlagValue() []string {
+	var dcs []string
+	for _, dc := range strings.Split(*datacenters, ",") {
+		dc = strings.TrimSpace(dc)
+		if dc != "" {
+			dcs = append(dcs, dc)
+		}
+	}
+	return dcs
+}
+
+// healthEntriesToOptions converts Consul health.Service results into
+// RedirectOptions, applying the -onlyHealthy/-healthFilter threshold and
+// sorting lowest -> highest port number for each hostname.
+func healthEntriesToOptions(services []*api.ServiceEntry) []RedirectOption {
+	var options []RedirectOption
+
+	minRank, filtering := minHealthRank()
+
+	for _, svc := range services {
+		status, detail := aggregateHealth(svc.Checks)
+		if filtering && healthStatusRank(status) > minRank {
+			continue
+		}
 
 		options = append(options, RedirectOption{
-			Hostname: svc.Node,
-			Tags:     svc.ServiceTags,
-			Port:     uint16(svc.ServicePort),
+			Hostname:     svc.Node.Node,
+			Tags:         svc.Service.Tags,
+			Port:         uint16(svc.Service.Port),
+			HealthStatus: status,
+			HealthDetail: detail,
 		})
 	}
 
-	// sort lowest -> highest port number for each hostname
 	sort.Slice(options, func(i, j int) bool {
 		return options[i].Hostname < options[j].Hostname && options[i].Port < options[j].Port
 	})
 
-	return options, nil
+	return options
 }
 
-func parseConsulAddress(hostname string) (svcName, svcType string) {
+// ConsulAddress is a hostname parsed as a Consul DNS-interface-style
+// service address.
+type ConsulAddress struct {
+	SvcName    string
+	SvcType    string
+	Namespace  string
+	Partition  string
+	Datacenter string
+}
+
+// parseConsulAddress parses a hostname in one of:
+//
+//	ServiceName.service.consul
+//	PortName.ServiceName.service.consul
+//	ServiceName.service.DatacenterName.consul
+//	PortName.ServiceName.service.DatacenterName.consul
+//
+// or Consul Enterprise's namespace/partition/datacenter DNS form:
+//
+//	[PortName.]ServiceName.service[.Namespace.ns][.Partition.ap][.Datacenter.dc].consul
+func parseConsulAddress(hostname string) ConsulAddress {
 	serviceSplit := strings.SplitN(hostname, ".service.", 2)
-	svcName = serviceSplit[0]
-	svcType = ""
+	svcName := serviceSplit[0]
+	svcType := ""
 
 	if strings.Contains(svcName, ".") {
 		parts := strings.SplitN(svcName, ".", 2)
@@ -436,10 +808,64 @@ func parseConsulAddress(hostname string) (svcName, svcType string) {
 
 	// don't parse IP addresses
 	if strings.Count(svcType, ".") > 0 {
-		return "", ""
+		return ConsulAddress{}
+	}
+
+	addr := ConsulAddress{SvcName: svcName, SvcType: svcType}
+	if len(serviceSplit) == 2 {
+		parseConsulAddressTail(serviceSplit[1], &addr)
+	}
+
+	return addr
+}
+
+// parseConsulAddressTail parses everything after "<svc>.service.": either
+// nothing ("consul"), a bare datacenter name ("DatacenterName.consul"), or
+// the Enterprise form with namespace/partition/datacenter labelled from the
+// right ("NAME.ns.NAME.ap.NAME.dc.consul" style segments).
+func parseConsulAddressTail(tail string, addr *ConsulAddress) {
+	tail = strings.TrimSuffix(strings.TrimSuffix(tail, "consul"), ".")
+
+	for {
+		if rest, dc, ok := cutLabelSuffix(tail, "dc"); ok {
+			addr.Datacenter = dc
+			tail = rest
+			continue
+		}
+		if rest, partition, ok := cutLabelSuffix(tail, "ap"); ok {
+			addr.Partition = partition
+			tail = rest
+			continue
+		}
+		if rest, ns, ok := cutLabelSuffix(tail, "ns"); ok {
+			addr.Namespace = ns
+			tail = rest
+			continue
+		}
+		break
+	}
+
+	// Nothing labelled ns/ap/dc: the legacy ServiceName.service.DC.consul form.
+	if tail != "" && addr.Namespace == "" && addr.Partition == "" && addr.Datacenter == "" {
+		addr.Datacenter = tail
+	}
+}
+
+// cutLabelSuffix splits "<rest>.<value>.<label>" into (rest, value, true) if
+// tail ends with ".<label>"; rest is empty when tail is just "<value>.<label>".
+func cutLabelSuffix(tail, label string) (rest, value string, ok bool) {
+	suffix := "." + label
+	if tail == "" || !strings.HasSuffix(tail, suffix) {
+		return tail, "", false
+	}
+
+	trimmed := strings.TrimSuffix(tail, suffix)
+	idx := strings.LastIndex(trimmed, ".")
+	if idx == -1 {
+		return "", trimmed, true
 	}
 
-	return svcName, svcType
+	return trimmed[:idx], trimmed[idx+1:], true
 }
 
 func getHostname(req *http.Request) string {
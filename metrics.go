@@ -0,0 +1,41 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_port_redirector_requests_total",
+		Help: "Total number of requests served, labeled by outcome (redirect, not_found, parse_error, consul_error, custom_route, nomad_ui).",
+	}, []string{"outcome"})
+
+	metricConsulQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consul_port_redirector_consul_query_duration_seconds",
+		Help:    "Latency of Consul catalog/health queries issued to resolve a hostname.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_port_redirector_cache_hits_total",
+		Help: "Number of catalog lookups served from the in-memory cache.",
+	})
+
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_port_redirector_cache_misses_total",
+		Help: "Number of catalog lookups that missed the in-memory cache and queried Consul directly.",
+	})
+
+	metricRedirectsByService = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_port_redirector_redirects_total",
+		Help: "Number of successful redirects, labeled by target service.",
+	}, []string{"svc_name", "svc_type", "datacenter"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequestsTotal,
+		metricConsulQueryDuration,
+		metricCacheHits,
+		metricCacheMisses,
+		metricRedirectsByService,
+	)
+}
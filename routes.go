@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Route describes a single tag-derived redirect target, built from a
+// "<tagPrefix><host>[/<path>] opt=val ..." service tag, fabio-style.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Scheme     string
+	TargetHost string
+	Port       uint16
+	Weight     int
+	Strip      string
+}
+
+// routeTable is a concurrency-safe, hostname-keyed set of Routes built from
+// Consul service tags. The zero value is not usable; use newRouteTable.
+type routeTable struct {
+	mu     sync.RWMutex
+	routes map[string][]Route
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{routes: map[string][]Route{}}
+}
+
+func (rt *routeTable) replace(routes map[string][]Route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = routes
+}
+
+// match returns the Route for host+path with the longest matching
+// PathPrefix, breaking ties between multiple instances by weighted random
+// selection.
+func (rt *routeTable) match(host, path string) (Route, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var best []Route
+	bestLen := -1
+	for _, r := range rt.routes[host] {
+		if !strings.HasPrefix(path, r.PathPrefix) {
+			continue
+		}
+		if len(r.PathPrefix) > bestLen {
+			bestLen = len(r.PathPrefix)
+			best = []Route{r}
+		} else if len(r.PathPrefix) == bestLen {
+			best = append(best, r)
+		}
+	}
+
+	if len(best) == 0 {
+		return Route{}, false
+	}
+
+	return weightedPick(best), true
+}
+
+func weightedPick(routes []Route) Route {
+	if len(routes) == 1 {
+		return routes[0]
+	}
+
+	total := 0
+	for _, r := range routes {
+		total += r.Weight
+	}
+	if total <= 0 {
+		return routes[rand.Intn(len(routes))]
+	}
+
+	n := rand.Intn(total)
+	for _, r := range routes {
+		if n < r.Weight {
+			return r
+		}
+		n -= r.Weight
+	}
+
+	return routes[len(routes)-1]
+}
+
+// parseRouteTag parses a single Consul service tag into a Route, returning
+// ok=false if the tag does not start with prefix. Recognized options are
+// proto=<scheme>, strip=<pathPrefix>, and weight=<N>.
+func parseRouteTag(tag, prefix string) (Route, bool) {
+	if !strings.HasPrefix(tag, prefix) {
+		return Route{}, false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(tag, prefix))
+	if len(fields) == 0 {
+		return Route{}, false
+	}
+
+	host, path := splitHostPath(fields[0])
+	route := Route{
+		Host:       host,
+		PathPrefix: path,
+		Scheme:     "http",
+		Weight:     1,
+	}
+
+	for _, opt := range fields[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "proto":
+			route.Scheme = kv[1]
+		case "strip":
+			route.Strip = kv[1]
+		case "weight":
+			if w, err := strconv.Atoi(kv[1]); err == nil && w > 0 {
+				route.Weight = w
+			}
+		}
+	}
+
+	return route, true
+}
+
+func splitHostPath(hostPath string) (host, path string) {
+	idx := strings.Index(hostPath, "/")
+	if idx == -1 {
+		return hostPath, "/"
+	}
+	return hostPath[:idx], hostPath[idx:]
+}
+
+// rebuildRoutes queries the Consul catalog for every registered service and
+// rebuilds the route table from any tags matching -tagPrefix.
+func (s *Server) rebuildRoutes() error {
+	names, _, err := s.consul.Catalog().Services(&api.QueryOptions{})
+	if err != nil {
+		return err
+	}
+
+	table := make(map[string][]Route)
+	for name := range names {
+		instances, _, err := s.consul.Catalog().Service(name, "", &api.QueryOptions{})
+		if err != nil {
+			log.Printf("error listing Consul instances of %s while rebuilding routes: %#v", name, err)
+			continue
+		}
+
+		for _, instance := range instances {
+			for _, tag := range instance.ServiceTags {
+				route, ok := parseRouteTag(tag, *tagPrefix)
+				if !ok {
+					continue
+				}
+
+				route.Port = uint16(instance.ServicePort)
+				route.TargetHost = instance.Node
+				table[route.Host] = append(table[route.Host], route)
+			}
+		}
+	}
+
+	s.routes.replace(table)
+	return nil
+}
+
+// watchRoutes rebuilds the route table whenever the Consul catalog changes,
+// using a blocking query so changes are detected without polling, and
+// falling back to a plain rebuild every -routeRefreshInterval in case the
+// blocking query's index tracking misses a change (e.g. after a Consul
+// leader election).
+func (s *Server) watchRoutes(ctx context.Context) {
+	var lastIndex uint64
+	var lastRebuild time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		_, meta, err := s.consul.Catalog().Services(&api.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  *routeRefreshInterval,
+		})
+		if err != nil {
+			log.Printf("error watching Consul catalog for route changes: %#v", err)
+			time.Sleep(*routeRefreshInterval)
+			continue
+		}
+
+		indexChanged := meta.LastIndex != lastIndex
+		lastIndex = meta.LastIndex
+
+		// The blocking query above returns at least every
+		// -routeRefreshInterval even with no index change, so checking the
+		// elapsed time here is what actually provides the periodic fallback
+		// rebuild promised above.
+		if indexChanged || time.Since(lastRebuild) >= *routeRefreshInterval {
+			if err := s.rebuildRoutes(); err != nil {
+				log.Printf("error rebuilding route table: %#v", err)
+			}
+			lastRebuild = time.Now()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import "testing"
+
+func TestParseRouteTag(t *testing.T) {
+	const prefix = "redir-"
+
+	tests := []struct {
+		name string
+		tag  string
+		want Route
+		ok   bool
+	}{
+		{
+			name: "bare host, defaults applied",
+			tag:  "redir-foo.example.com",
+			want: Route{Host: "foo.example.com", PathPrefix: "/", Scheme: "http", Weight: 1},
+			ok:   true,
+		},
+		{
+			name: "host with path",
+			tag:  "redir-foo.example.com/api",
+			want: Route{Host: "foo.example.com", PathPrefix: "/api", Scheme: "http", Weight: 1},
+			ok:   true,
+		},
+		{
+			name: "all options set",
+			tag:  "redir-foo.example.com/api proto=https strip=/api weight=3",
+			want: Route{Host: "foo.example.com", PathPrefix: "/api", Scheme: "https", Strip: "/api", Weight: 3},
+			ok:   true,
+		},
+		{
+			name: "non-positive weight is ignored, default kept",
+			tag:  "redir-foo.example.com weight=0",
+			want: Route{Host: "foo.example.com", PathPrefix: "/", Scheme: "http", Weight: 1},
+			ok:   true,
+		},
+		{
+			name: "malformed weight is ignored, default kept",
+			tag:  "redir-foo.example.com weight=notanumber",
+			want: Route{Host: "foo.example.com", PathPrefix: "/", Scheme: "http", Weight: 1},
+			ok:   true,
+		},
+		{
+			name: "option without = is ignored",
+			tag:  "redir-foo.example.com bogus",
+			want: Route{Host: "foo.example.com", PathPrefix: "/", Scheme: "http", Weight: 1},
+			ok:   true,
+		},
+		{
+			name: "unrelated tag",
+			tag:  "urlprefix-foo.example.com",
+			want: Route{},
+			ok:   false,
+		},
+		{
+			name: "prefix with nothing after it",
+			tag:  "redir-",
+			want: Route{},
+			ok:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRouteTag(tt.tag, prefix)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseRouteTag(%q, %q) = (%+v, %v), want (%+v, %v)", tt.tag, prefix, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWeightedPickSingleRoute(t *testing.T) {
+	routes := []Route{{Host: "only.example.com", Weight: 1}}
+
+	for i := 0; i < 10; i++ {
+		if got := weightedPick(routes); got != routes[0] {
+			t.Fatalf("weightedPick(%+v) = %+v, want the only route unchanged", routes, got)
+		}
+	}
+}
+
+func TestWeightedPickZeroTotalWeightStaysWithinOptions(t *testing.T) {
+	routes := []Route{
+		{Host: "a.example.com", Weight: 0},
+		{Host: "b.example.com", Weight: 0},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		got := weightedPick(routes)
+		found := false
+		for _, r := range routes {
+			if got == r {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("weightedPick(%+v) = %+v, not one of the inputs", routes, got)
+		}
+		seen[got.Host] = true
+	}
+
+	if len(seen) != len(routes) {
+		t.Errorf("weightedPick with all-zero weights only ever returned %v over 200 tries, want a chance at both", seen)
+	}
+}
+
+func TestWeightedPickRespectsWeightBoundaries(t *testing.T) {
+	// With weight=3 for a and weight=0 for b, rand.Intn(3) is always in
+	// [0,3), which is always < a's weight, so b should never be picked.
+	routes := []Route{
+		{Host: "a.example.com", Weight: 3},
+		{Host: "b.example.com", Weight: 0},
+	}
+
+	for i := 0; i < 200; i++ {
+		if got := weightedPick(routes); got.Host != "a.example.com" {
+			t.Fatalf("weightedPick(%+v) = %+v, want a.example.com every time", routes, got)
+		}
+	}
+}
+
+func TestSplitHostPath(t *testing.T) {
+	tests := []struct {
+		hostPath string
+		wantHost string
+		wantPath string
+	}{
+		{hostPath: "foo.example.com", wantHost: "foo.example.com", wantPath: "/"},
+		{hostPath: "foo.example.com/", wantHost: "foo.example.com", wantPath: "/"},
+		{hostPath: "foo.example.com/api/v1", wantHost: "foo.example.com", wantPath: "/api/v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostPath, func(t *testing.T) {
+			host, path := splitHostPath(tt.hostPath)
+			if host != tt.wantHost || path != tt.wantPath {
+				t.Errorf("splitHostPath(%q) = (%q, %q), want (%q, %q)", tt.hostPath, host, path, tt.wantHost, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tlsManager supplies certificates for the HTTPS listener, either by
+// minting per-SNI leaves from an in-memory CA (-selfSigned), or by loading
+// PEM cert/key pairs from -certDir/-keyDir and reloading them on SIGHUP.
+type tlsManager struct {
+	mu sync.RWMutex
+
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+	leaves map[string]*tls.Certificate
+
+	fileCerts map[string]*tls.Certificate
+}
+
+func newTLSManager() (*tlsManager, error) {
+	m := &tlsManager{}
+
+	if *selfSigned {
+		if err := m.generateCA(); err != nil {
+			return nil, err
+		}
+		m.leaves = map[string]*tls.Certificate{}
+		return m, nil
+	}
+
+	if err := m.loadFileCerts(); err != nil {
+		return nil, err
+	}
+
+	go m.watchSIGHUP()
+
+	return m, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, selecting a
+// certificate by the SNI server name the client requested.
+func (m *tlsManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		return nil, fmt.Errorf("client did not send an SNI server name")
+	}
+
+	if *selfSigned {
+		return m.leafFor(hello.ServerName)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cert, ok := m.fileCerts[hello.ServerName]
+	if !ok {
+		return nil, fmt.Errorf("no TLS certificate configured for %s", hello.ServerName)
+	}
+
+	return cert, nil
+}
+
+func (m *tlsManager) generateCA() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "consul-port-redirector self-signed CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	m.caCert = cert
+	m.caKey = key
+	return nil
+}
+
+// leafFor returns the cached leaf certificate for name, minting and caching
+// a new one signed by the in-memory CA if none exists yet.
+func (m *tlsManager) leafFor(name string) (*tls.Certificate, error) {
+	m.mu.RLock()
+	cert, ok := m.leaves[name]
+	m.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cert, ok := m.leaves[name]; ok {
+		return cert, nil
+	}
+
+	cert, err := m.mintLeaf(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.leaves[name] = cert
+	return cert, nil
+}
+
+func (m *tlsManager) mintLeaf(name string) (*tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.caCert, &key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, m.caCert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// loadFileCerts (re)loads every cert/key pair from -certDir/-keyDir, keying
+// each by the certificate's DNS SANs and common name.
+func (m *tlsManager) loadFileCerts() error {
+	entries, err := os.ReadDir(*certDir)
+	if err != nil {
+		return err
+	}
+
+	certs := map[string]*tls.Certificate{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		certPath := filepath.Join(*certDir, entry.Name())
+		keyPath := filepath.Join(*keyDir, entry.Name())
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			log.Printf("error loading TLS cert/key pair %s: %#v", entry.Name(), err)
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Printf("error parsing TLS certificate %s: %#v", entry.Name(), err)
+			continue
+		}
+
+		names := leaf.DNSNames
+		if leaf.Subject.CommonName != "" {
+			names = append(names, leaf.Subject.CommonName)
+		}
+
+		for _, name := range names {
+			certCopy := cert
+			certs[name] = &certCopy
+		}
+	}
+
+	m.mu.Lock()
+	m.fileCerts = certs
+	m.mu.Unlock()
+
+	log.Printf("loaded %d TLS certificate(s) from %s", len(certs), *certDir)
+	return nil
+}
+
+func (m *tlsManager) watchSIGHUP() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	for range sigCh {
+		log.Printf("SIGHUP received, reloading TLS certificates from %s", *certDir)
+		if err := m.loadFileCerts(); err != nil {
+			log.Printf("error reloading TLS certificates: %#v", err)
+		}
+	}
+}